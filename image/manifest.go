@@ -23,90 +23,560 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/naming"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/seed"
 	"github.com/snapcore/snapd/snap"
 )
 
 // The seed.manifest generated by ubuntu-image contains entries in the following
 // format:
-// <snap-name> <snap-revision>
-// The goal in a future iteration of this will be to move the generation of the
-// seed.manifest to this package, out of ubuntu-image.
-// TODO: Move generation of seed.manifest from ubuntu-image to here
-
-// ReadSeedManifest reads a seed.manifest generated by ubuntu-image, and returns
-// a map containing the snap names and their revisions.
-func ReadSeedManifest(manifestFile string) (map[string]snap.Revision, error) {
+// <snap-name> <snap-revision> [<snap-sha3-384>]
+// The sha3-384 is optional, and when present must match the snap-sha3-384
+// header of the snap-revision assertion for that snap, allowing the contents
+// of the seed to be verified independently of the store.
+// It may also pin the validation-set assertions that were enforced while
+// building the image, one per line, in the following format:
+// <account-id>/<name>=<sequence>
+// or, when the sequence used was whatever was latest at build time:
+// <account-id>/<name>
+// The file may start with a header block of comment lines of the form
+// "# key: value", recording context about the build (model, brand,
+// timestamp, snapd-version, ...). The header block must open the file: it
+// ends at the first line that is not of that form, and any later "#"
+// comment is free-form and ignored.
+
+// validSnapSHA3_384 matches the base64url-encoded sha3-384 digest used in
+// the snap-sha3-384 header of snap-revision assertions.
+var validSnapSHA3_384 = regexp.MustCompile(`^[a-zA-Z0-9_-]{64}$`)
+
+// manifestHeaderLine matches a structured header comment of the form
+// "# key: value".
+var manifestHeaderLine = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9_-]*)\s*:\s*(.*)$`)
+
+// validateManifestHeader checks the value of the well-known seed.manifest
+// headers. Unknown headers are accepted as-is, for forward compatibility.
+func validateManifestHeader(key, value string) error {
+	switch key {
+	case "model":
+		parts := strings.SplitN(value, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("header %q must be of the form <brand-id>/<model>: %q", key, value)
+		}
+		if err := naming.ValidateAccountID(parts[0]); err != nil {
+			return err
+		}
+		if err := naming.ValidateModel(parts[1]); err != nil {
+			return err
+		}
+	case "brand":
+		if err := naming.ValidateAccountID(value); err != nil {
+			return err
+		}
+	case "timestamp":
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return fmt.Errorf("header %q is not a valid RFC3339 timestamp: %q", key, value)
+		}
+	}
+	return nil
+}
+
+// ValidationSetMode describes whether a validation-set pin recorded in a
+// seed.manifest was explicitly pinned to a sequence, or resolved to whatever
+// was latest when the image was built.
+type ValidationSetMode int
+
+const (
+	// ValidationSetModePinned means the sequence recorded alongside the
+	// validation-set must be used again.
+	ValidationSetModePinned ValidationSetMode = iota
+	// ValidationSetModeLatest means the validation-set was not pinned to
+	// a specific sequence when the image was built.
+	ValidationSetModeLatest
+)
+
+// ValidationSetPin represents a validation-set assertion recorded in a
+// seed.manifest, so a later invocation of prepare-image can fetch and
+// enforce the very same sequence.
+type ValidationSetPin struct {
+	AccountID string
+	Name      string
+	Sequence  int
+	Mode      ValidationSetMode
+}
+
+func (vs *ValidationSetPin) key() string {
+	return fmt.Sprintf("%s/%s", vs.AccountID, vs.Name)
+}
+
+func (vs *ValidationSetPin) String() string {
+	if vs.Mode == ValidationSetModeLatest {
+		return vs.key()
+	}
+	return fmt.Sprintf("%s=%d", vs.key(), vs.Sequence)
+}
+
+// parseValidationSetPin parses a single token of the form
+// <account-id>/<name> or <account-id>/<name>=<sequence>.
+func parseValidationSetPin(token string) (*ValidationSetPin, error) {
+	accountAndName := token
+	seqString := ""
+	hasSeq := false
+	if idx := strings.IndexByte(token, '='); idx != -1 {
+		accountAndName = token[:idx]
+		seqString = token[idx+1:]
+		hasSeq = true
+	}
+
+	parts := strings.SplitN(accountAndName, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("line is illegally formatted: %q", token)
+	}
+	accountID, name := parts[0], parts[1]
+	if err := naming.ValidateAccountID(accountID); err != nil {
+		return nil, err
+	}
+	if err := naming.ValidateValidationSetName(name); err != nil {
+		return nil, err
+	}
+
+	vs := &ValidationSetPin{
+		AccountID: accountID,
+		Name:      name,
+		Mode:      ValidationSetModeLatest,
+	}
+	if hasSeq {
+		if seqString == "" {
+			return nil, fmt.Errorf("line is illegally formatted: %q", token)
+		}
+		seq, err := strconv.Atoi(seqString)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse validation-set sequence: %q", token)
+		}
+		// Unlike snap revisions, there is no meaning to a negative or
+		// zero validation-set sequence: sequences start at 1.
+		if seq < 1 {
+			return nil, fmt.Errorf("cannot use sequence %d for validation-set %q: sequence must be a positive integer", seq, accountAndName)
+		}
+		vs.Sequence = seq
+		vs.Mode = ValidationSetModePinned
+	}
+	return vs, nil
+}
+
+// ReconcileValidationSets checks that every validation-set pinned in
+// manifest was resolved to the very same sequence while building the
+// image, and returns an error describing the drift otherwise. Validation-
+// sets recorded with ValidationSetModeLatest are not checked, since by
+// definition they were not pinned to a specific sequence.
+//
+// resolved is the list of validation-set assertions (account-id, name and
+// sequence) that were actually fetched and enforced at image-build time.
+func ReconcileValidationSets(manifest *SeedManifest, resolved []*ValidationSetPin) error {
+	resolvedByKey := make(map[string]*ValidationSetPin, len(resolved))
+	for _, vs := range resolved {
+		resolvedByKey[vs.key()] = vs
+	}
+
+	for _, pin := range manifest.ValidationSets {
+		if pin.Mode != ValidationSetModePinned {
+			continue
+		}
+		got, ok := resolvedByKey[pin.key()]
+		if !ok {
+			return fmt.Errorf("validation-set %q is pinned to sequence %d by the seed.manifest, but was not enforced while building the image", pin.key(), pin.Sequence)
+		}
+		if got.Sequence != pin.Sequence {
+			return fmt.Errorf("validation-set %q is pinned to sequence %d by the seed.manifest, but sequence %d was enforced while building the image", pin.key(), pin.Sequence, got.Sequence)
+		}
+	}
+	return nil
+}
+
+// SeedManifestSnapRevision records a single snap's pinned revision and,
+// optionally, the sha3-384 digest of the snap file that was sealed into the
+// seed.
+type SeedManifestSnapRevision struct {
+	Revision snap.Revision
+	SHA3_384 string
+}
+
+// SeedManifest is the parsed representation of a seed.manifest file, as
+// read by ReadSeedManifest or assembled in memory for use with
+// WriteSeedManifest.
+type SeedManifest struct {
+	// Headers records the optional leading "# key: value" header block,
+	// if the manifest has one.
+	Headers        map[string]string
+	Snaps          map[string]*SeedManifestSnapRevision
+	ValidationSets []*ValidationSetPin
+}
+
+// NewSeedManifest returns an empty, ready to use SeedManifest.
+func NewSeedManifest() *SeedManifest {
+	return &SeedManifest{
+		Headers: make(map[string]string),
+		Snaps:   make(map[string]*SeedManifestSnapRevision),
+	}
+}
+
+// SetAllowedSnapRevision records the revision, and optionally the
+// sha3-384 digest, pinned for the given snap.
+func (m *SeedManifest) SetAllowedSnapRevision(snapName string, rev snap.Revision, sha3_384 string) {
+	m.Snaps[snapName] = &SeedManifestSnapRevision{Revision: rev, SHA3_384: sha3_384}
+}
+
+// SnapRevisions returns the legacy map of just the snap revisions, for
+// callers that don't care about snap digests or pinned validation-sets.
+func (m *SeedManifest) SnapRevisions() map[string]snap.Revision {
+	revisions := make(map[string]snap.Revision, len(m.Snaps))
+	for name, entry := range m.Snaps {
+		revisions[name] = entry.Revision
+	}
+	return revisions
+}
+
+// CheckSnapFileDigest verifies that the given snap file matches the
+// sha3-384 digest pinned for snapName, if one was recorded in the manifest.
+// It is a no-op if no digest was pinned for this snap.
+func (m *SeedManifest) CheckSnapFileDigest(snapName, snapFile string) error {
+	entry, ok := m.Snaps[snapName]
+	if !ok || entry.SHA3_384 == "" {
+		return nil
+	}
+	digest, _, err := asserts.SnapFileSHA3_384(snapFile)
+	if err != nil {
+		return fmt.Errorf("cannot compute digest of snap %q: %v", snapName, err)
+	}
+	if digest != entry.SHA3_384 {
+		return fmt.Errorf("snap %q does not match the digest pinned in the seed.manifest: expected %s but got %s", snapName, entry.SHA3_384, digest)
+	}
+	return nil
+}
+
+// ReadSeedManifest reads a seed.manifest generated by ubuntu-image, and
+// returns the snap revisions (and, if present, their digests), together with
+// any pinned validation-set assertions it records.
+func ReadSeedManifest(manifestFile string) (*SeedManifest, error) {
 	f, err := os.Open(manifestFile)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	revisions := make(map[string]snap.Revision)
+	manifest := NewSeedManifest()
+	seenVsets := make(map[string]bool)
+	inHeader := true
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := scanner.Text()
 		if strings.HasPrefix(line, "#") {
+			if inHeader {
+				if m := manifestHeaderLine.FindStringSubmatch(line); m != nil {
+					key, value := m[1], m[2]
+					if _, ok := manifest.Headers[key]; ok {
+						return nil, fmt.Errorf("header %q already set in seed.manifest", key)
+					}
+					if err := validateManifestHeader(key, value); err != nil {
+						return nil, err
+					}
+					manifest.Headers[key] = value
+					continue
+				}
+				inHeader = false
+			}
 			continue
 		}
+		inHeader = false
 		if strings.HasPrefix(line, " ") {
 			return nil, fmt.Errorf("line cannot start with any spaces: %q", line)
 		}
 
 		tokens := strings.Fields(line)
-		// Expect exactly two tokens
-		if len(tokens) != 2 {
+		switch len(tokens) {
+		case 0:
+			continue
+		case 1:
+			vs, err := parseValidationSetPin(tokens[0])
+			if err != nil {
+				return nil, err
+			}
+			if seenVsets[vs.key()] {
+				return nil, fmt.Errorf("cannot use validation-set %q more than once", vs.key())
+			}
+			seenVsets[vs.key()] = true
+			manifest.ValidationSets = append(manifest.ValidationSets, vs)
+		case 2, 3:
+			snapName := tokens[0]
+			revString := tokens[1]
+			if err := snap.ValidateName(snapName); err != nil {
+				return nil, err
+			}
+
+			rev, err := snap.ParseRevision(revString)
+			if err != nil {
+				return nil, err
+			}
+
+			// Values that are higher than 0 indicate the revision comes from the store, and values
+			// lower than 0 indicate the snap was sourced locally. We allow both in the seed.manifest as
+			// long as the user can provide us with the correct snaps. The only number we won't accept is
+			// 0.
+			if rev.Unset() {
+				return nil, fmt.Errorf("cannot use revision %d for snap %q: revision must not be 0", rev, snapName)
+			}
+
+			sha3_384 := ""
+			if len(tokens) == 3 {
+				sha3_384 = tokens[2]
+				if !validSnapSHA3_384.MatchString(sha3_384) {
+					return nil, fmt.Errorf("cannot use digest %q for snap %q: not a valid sha3-384 digest", sha3_384, snapName)
+				}
+			}
+			manifest.SetAllowedSnapRevision(snapName, rev, sha3_384)
+		default:
 			return nil, fmt.Errorf("line is illegally formatted: %q", line)
 		}
+	}
+	return manifest, nil
+}
 
-		snapName := tokens[0]
-		revString := tokens[1]
-		if err := snap.ValidateName(snapName); err != nil {
-			return nil, err
+// writeManifest serializes manifest to w in the canonical seed.manifest
+// format: an optional header block sorted by key, followed by snap lines
+// sorted by snap name, followed by validation-set lines sorted by
+// account-id/name.
+func writeManifest(w io.Writer, manifest *SeedManifest) error {
+	headerKeys := make([]string, 0, len(manifest.Headers))
+	for k := range manifest.Headers {
+		headerKeys = append(headerKeys, k)
+	}
+	sort.Strings(headerKeys)
+	for _, key := range headerKeys {
+		if err := validateManifestHeader(key, manifest.Headers[key]); err != nil {
+			return err
 		}
+		fmt.Fprintf(w, "# %s: %s\n", key, manifest.Headers[key])
+	}
 
-		rev, err := snap.ParseRevision(revString)
-		if err != nil {
-			return nil, err
+	keys := make([]string, 0, len(manifest.Snaps))
+	for k := range manifest.Snaps {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	vsKeys := make([]string, 0, len(manifest.ValidationSets))
+	vsByKey := make(map[string]*ValidationSetPin, len(manifest.ValidationSets))
+	for _, vs := range manifest.ValidationSets {
+		key := vs.key()
+		if _, ok := vsByKey[key]; ok {
+			return fmt.Errorf("cannot use validation-set %q more than once", key)
 		}
+		vsByKey[key] = vs
+		vsKeys = append(vsKeys, key)
+	}
+	sort.Strings(vsKeys)
 
-		// Values that are higher than 0 indicate the revision comes from the store, and values
-		// lower than 0 indicate the snap was sourced locally. We allow both in the seed.manifest as
-		// long as the user can provide us with the correct snaps. The only number we won't accept is
-		// 0.
-		if rev.Unset() {
-			return nil, fmt.Errorf("cannot use revision %d for snap %q: revision must not be 0", rev, snapName)
+	for _, key := range keys {
+		entry := manifest.Snaps[key]
+		if entry.Revision.Unset() {
+			return fmt.Errorf("revision must not be 0 for snap %q", key)
+		}
+		if entry.SHA3_384 != "" {
+			fmt.Fprintf(w, "%s %s %s\n", key, entry.Revision, entry.SHA3_384)
+		} else {
+			fmt.Fprintf(w, "%s %s\n", key, entry.Revision)
+		}
+	}
+	for _, key := range vsKeys {
+		vs := vsByKey[key]
+		if vs.Mode == ValidationSetModePinned && vs.Sequence == 0 {
+			return fmt.Errorf("sequence must not be 0 for validation-set %q", key)
 		}
-		revisions[snapName] = rev
+		fmt.Fprintf(w, "%s\n", vs)
 	}
-	return revisions, nil
+	return nil
 }
 
-// WriteSeedManifest generates the seed.manifest contents from the provided map of
-// snaps and their revisions, and stores them in the given file path
-func WriteSeedManifest(filePath string, revisions map[string]snap.Revision) error {
-	if len(revisions) == 0 {
+// WriteSeedManifest generates the seed.manifest contents from the provided
+// manifest, and stores them in the given file path.
+func WriteSeedManifest(filePath string, manifest *SeedManifest) error {
+	if len(manifest.Snaps) == 0 && len(manifest.ValidationSets) == 0 && len(manifest.Headers) == 0 {
 		return nil
 	}
 
-	keys := make([]string, 0, len(revisions))
-	for k := range revisions {
-		keys = append(keys, k)
+	buf := bytes.NewBuffer(nil)
+	if err := writeManifest(buf, manifest); err != nil {
+		return err
 	}
-	sort.Strings(keys)
+	return osutil.AtomicWriteFile(filePath, buf.Bytes(), 0755, 0)
+}
 
-	buf := bytes.NewBuffer(nil)
-	for _, key := range keys {
-		rev := revisions[key]
-		if rev.Unset() {
-			return fmt.Errorf("revision must not be 0 for snap %q", key)
+// ManifestOptions controls how GenerateSeedManifest derives the
+// seed.manifest for a prepared seed.
+type ManifestOptions struct {
+	// IncludeLocal controls whether snaps that were sourced locally
+	// (recorded with a negative revision) are included in the generated
+	// manifest. Local snaps cannot be refetched from the store, so they
+	// are excluded by default.
+	IncludeLocal bool
+	// Pinned, if set, is a previously generated seed.manifest (e.g. the
+	// one a rebuild was asked to reproduce). Every snap sealed into the
+	// seed is checked against the digest Pinned recorded for it, giving
+	// a tamper-evidence check independent of the store. A mismatch fails
+	// the build rather than silently sealing a different snap.
+	Pinned *SeedManifest
+}
+
+// snapIterator is the subset of seed.Seed that snapsFromSeed needs. It is
+// narrowed down from the full interface so the snap-merging logic (dedup,
+// IncludeLocal, Pinned) can be exercised with a lightweight fake in tests,
+// without having to implement all of seed.Seed.
+type snapIterator interface {
+	Iter(func(sn *seed.Snap) error) error
+}
+
+// snapsFromSeed extracts the effective revision and sha3-384 digest of
+// every snap actually placed in sd into manifest, deduplicating snaps that
+// appear in more than one UC20+ grade.
+func snapsFromSeed(manifest *SeedManifest, sd snapIterator, opts *ManifestOptions) error {
+	return sd.Iter(func(sn *seed.Snap) error {
+		if opts.Pinned != nil {
+			if err := opts.Pinned.CheckSnapFileDigest(sn.SideInfo.RealName, sn.Path); err != nil {
+				return err
+			}
+		}
+
+		if _, ok := manifest.Snaps[sn.SideInfo.RealName]; ok {
+			// Already recorded while processing another grade/system.
+			return nil
+		}
+		if sn.SideInfo.Revision.Local() && !opts.IncludeLocal {
+			return nil
+		}
+
+		digest, _, err := asserts.SnapFileSHA3_384(sn.Path)
+		if err != nil {
+			return fmt.Errorf("cannot compute digest of snap %q: %v", sn.SideInfo.RealName, err)
+		}
+		manifest.SetAllowedSnapRevision(sn.SideInfo.RealName, sn.SideInfo.Revision, digest)
+		return nil
+	})
+}
+
+// addEnforcedValidationSets records, in manifest, the validation-sets the
+// seeded model required to be enforced, so a later rebuild can pin and
+// re-verify the very same sequences via ReconcileValidationSets. Pins
+// already present in manifest (e.g. recorded while processing another
+// system) take precedence.
+func addEnforcedValidationSets(manifest *SeedManifest, sd seed.Seed) error {
+	model := sd.Model()
+	if model == nil {
+		return nil
+	}
+
+	seen := make(map[string]bool, len(manifest.ValidationSets))
+	for _, vs := range manifest.ValidationSets {
+		seen[vs.key()] = true
+	}
+
+	for _, mvs := range model.ValidationSets() {
+		pin := &ValidationSetPin{
+			AccountID: mvs.AccountID(),
+			Name:      mvs.Name(),
+		}
+		if seq := mvs.Sequence(); seq != 0 {
+			pin.Sequence = seq
+			pin.Mode = ValidationSetModePinned
+		} else {
+			pin.Mode = ValidationSetModeLatest
+		}
+		if seen[pin.key()] {
+			continue
+		}
+		seen[pin.key()] = true
+		manifest.ValidationSets = append(manifest.ValidationSets, pin)
+	}
+	return nil
+}
+
+// loadSeedIntoManifest loads the assertions and snap metadata for a single
+// opened seed (one Core 16/18 seed, or one UC20+ system/grade), and merges
+// its snaps and enforced validation-sets into manifest.
+func loadSeedIntoManifest(manifest *SeedManifest, sd seed.Seed, opts *ManifestOptions) error {
+	if err := sd.LoadAssertions(nil, nil); err != nil {
+		return err
+	}
+	if err := sd.LoadMeta(seed.AllModes, nil, nil); err != nil {
+		return err
+	}
+	if err := snapsFromSeed(manifest, sd, opts); err != nil {
+		return err
+	}
+	return addEnforcedValidationSets(manifest, sd)
+}
+
+// GenerateSeedManifest walks a prepared seed in seedDir and derives a
+// SeedManifest recording the effective revision and digest of every snap
+// actually placed in the seed, and the validation-sets enforced while
+// building it. It handles both the Core 16/18 layout and the UC20+
+// grade-specific layout (systems/<label>/), merging and deduplicating
+// snaps and validation-sets that are shared between grades.
+func GenerateSeedManifest(seedDir string, opts *ManifestOptions) (*SeedManifest, error) {
+	if opts == nil {
+		opts = &ManifestOptions{}
+	}
+
+	manifest := NewSeedManifest()
+
+	systems, err := seed.ListSystems(seedDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if len(systems) == 0 {
+		// A Core 16/18 seed has no systems/ subtree: there is a single,
+		// ungraded layout to load.
+		sd, err := seed.Open(seedDir, "")
+		if err != nil {
+			return nil, err
+		}
+		if err := loadSeedIntoManifest(manifest, sd, opts); err != nil {
+			return nil, err
+		}
+		return manifest, nil
+	}
+
+	for _, sys := range systems {
+		sd, err := seed.Open(seedDir, sys.Label)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open seed system %q: %v", sys.Label, err)
+		}
+		if err := loadSeedIntoManifest(manifest, sd, opts); err != nil {
+			return nil, fmt.Errorf("cannot process seed system %q: %v", sys.Label, err)
 		}
-		fmt.Fprintf(buf, "%s %s\n", key, rev)
 	}
-	return ioutil.WriteFile(filePath, buf.Bytes(), 0755)
-}
\ No newline at end of file
+	return manifest, nil
+}
+
+// PrepareManifest writes the seed.manifest for a single seed (one Core
+// 16/18 seed, or one already-opened UC20+ system) that the caller has
+// already loaded, without re-reading it from the filesystem.
+func PrepareManifest(w io.Writer, sd seed.Seed) error {
+	manifest := NewSeedManifest()
+	if err := snapsFromSeed(manifest, sd, &ManifestOptions{}); err != nil {
+		return err
+	}
+	if err := addEnforcedValidationSets(manifest, sd); err != nil {
+		return err
+	}
+	return writeManifest(w, manifest)
+}
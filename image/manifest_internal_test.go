@@ -0,0 +1,152 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
+)
+
+// fakeSnapIterator is a minimal snapIterator, letting snapsFromSeed's
+// merge logic be exercised without a real, fully prepared seed.
+type fakeSnapIterator struct {
+	snaps []*seed.Snap
+}
+
+func (f *fakeSnapIterator) Iter(fn func(sn *seed.Snap) error) error {
+	for _, sn := range f.snaps {
+		if err := fn(sn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFakeSnapFile(t *testing.T, dir, name string, contents []byte) string {
+	path := filepath.Join(dir, name+".snap")
+	if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return path
+}
+
+func TestSnapsFromSeedDedupesAcrossSystems(t *testing.T) {
+	dir := t.TempDir()
+	corePath := writeFakeSnapFile(t, dir, "core22", []byte("core22 contents"))
+
+	manifest := NewSeedManifest()
+	opts := &ManifestOptions{}
+
+	// First system/grade records core22...
+	first := &fakeSnapIterator{snaps: []*seed.Snap{
+		{Path: corePath, SideInfo: &snap.SideInfo{RealName: "core22", Revision: snap.R(1)}},
+	}}
+	if err := snapsFromSeed(manifest, first, opts); err != nil {
+		t.Fatalf("snapsFromSeed failed: %v", err)
+	}
+
+	// ...a second system/grade shares the same snap, at what would be a
+	// different revision if it were recorded again: it must be ignored.
+	second := &fakeSnapIterator{snaps: []*seed.Snap{
+		{Path: corePath, SideInfo: &snap.SideInfo{RealName: "core22", Revision: snap.R(2)}},
+	}}
+	if err := snapsFromSeed(manifest, second, opts); err != nil {
+		t.Fatalf("snapsFromSeed failed: %v", err)
+	}
+
+	if len(manifest.Snaps) != 1 {
+		t.Fatalf("expected exactly one recorded snap, got %#v", manifest.Snaps)
+	}
+	if manifest.Snaps["core22"].Revision != snap.R(1) {
+		t.Errorf("expected the first system's revision to win, got %v", manifest.Snaps["core22"].Revision)
+	}
+}
+
+func TestSnapsFromSeedIncludeLocal(t *testing.T) {
+	dir := t.TempDir()
+	localPath := writeFakeSnapFile(t, dir, "local-snap", []byte("local contents"))
+	it := &fakeSnapIterator{snaps: []*seed.Snap{
+		{Path: localPath, SideInfo: &snap.SideInfo{RealName: "local-snap", Revision: snap.R(-1)}},
+	}}
+
+	manifest := NewSeedManifest()
+	if err := snapsFromSeed(manifest, it, &ManifestOptions{IncludeLocal: false}); err != nil {
+		t.Fatalf("snapsFromSeed failed: %v", err)
+	}
+	if _, ok := manifest.Snaps["local-snap"]; ok {
+		t.Errorf("expected local snap to be excluded by default")
+	}
+
+	manifest = NewSeedManifest()
+	if err := snapsFromSeed(manifest, it, &ManifestOptions{IncludeLocal: true}); err != nil {
+		t.Fatalf("snapsFromSeed failed: %v", err)
+	}
+	entry, ok := manifest.Snaps["local-snap"]
+	if !ok {
+		t.Fatalf("expected local snap to be recorded when IncludeLocal is set")
+	}
+	if entry.SHA3_384 == "" {
+		t.Errorf("expected a digest to be recorded for the local snap too")
+	}
+}
+
+func TestSnapsFromSeedChecksPinnedDigest(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFakeSnapFile(t, dir, "core22", []byte("core22 contents"))
+	it := &fakeSnapIterator{snaps: []*seed.Snap{
+		{Path: path, SideInfo: &snap.SideInfo{RealName: "core22", Revision: snap.R(1)}},
+	}}
+
+	// A pinned manifest with the correct digest is accepted.
+	pinned := NewSeedManifest()
+	if err := snapsFromSeed(pinned, it, &ManifestOptions{}); err != nil {
+		t.Fatalf("snapsFromSeed failed: %v", err)
+	}
+
+	manifest := NewSeedManifest()
+	if err := snapsFromSeed(manifest, it, &ManifestOptions{Pinned: pinned}); err != nil {
+		t.Errorf("expected no error verifying against a matching pinned digest, got: %v", err)
+	}
+
+	// A pinned manifest recording a different digest for the same snap
+	// (i.e. the snap file was tampered with or swapped) must fail loudly,
+	// including for locally-sourced snaps.
+	localPath := writeFakeSnapFile(t, dir, "local-snap", []byte("original contents"))
+	tamperedIt := &fakeSnapIterator{snaps: []*seed.Snap{
+		{Path: localPath, SideInfo: &snap.SideInfo{RealName: "local-snap", Revision: snap.R(-1)}},
+	}}
+	tamperedPinned := NewSeedManifest()
+	if err := snapsFromSeed(tamperedPinned, tamperedIt, &ManifestOptions{IncludeLocal: true}); err != nil {
+		t.Fatalf("snapsFromSeed failed: %v", err)
+	}
+	if err := ioutil.WriteFile(localPath, []byte("tampered contents"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	manifest = NewSeedManifest()
+	err := snapsFromSeed(manifest, tamperedIt, &ManifestOptions{IncludeLocal: true, Pinned: tamperedPinned})
+	if err == nil {
+		t.Errorf("expected a tampered local snap to be rejected against a pinned manifest")
+	}
+}
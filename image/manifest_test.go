@@ -0,0 +1,301 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/image"
+	"github.com/snapcore/snapd/snap"
+)
+
+func TestReadSeedManifestValidationSetErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"zero sequence", "canonical/base-set=0\n"},
+		{"negative sequence", "canonical/base-set=-3\n"},
+		{"trailing equals", "canonical/base-set=\n"},
+		{"non-numeric sequence", "canonical/base-set=abc\n"},
+		{"missing name", "canonical/\n"},
+		{"bad account id", "bad_account/base-set=1\n"},
+		{"bad name", "canonical/Not_A_Valid_Name=1\n"},
+		{"name containing slash", "canonical/base-set/extra=1\n"},
+		{"duplicate", "canonical/base-set=1\ncanonical/base-set=2\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "seed.manifest")
+			if err := ioutil.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+			if _, err := image.ReadSeedManifest(path); err == nil {
+				t.Errorf("expected an error reading manifest with content %q, got none", tc.content)
+			}
+		})
+	}
+}
+
+func TestReconcileValidationSets(t *testing.T) {
+	manifest := image.NewSeedManifest()
+	manifest.ValidationSets = []*image.ValidationSetPin{
+		{AccountID: "canonical", Name: "base-set", Sequence: 4, Mode: image.ValidationSetModePinned},
+		{AccountID: "canonical", Name: "unpinned-set", Mode: image.ValidationSetModeLatest},
+	}
+
+	// Matching sequence: no error.
+	err := image.ReconcileValidationSets(manifest, []*image.ValidationSetPin{
+		{AccountID: "canonical", Name: "base-set", Sequence: 4, Mode: image.ValidationSetModePinned},
+	})
+	if err != nil {
+		t.Errorf("expected no drift, got: %v", err)
+	}
+
+	// Drifted sequence: error.
+	err = image.ReconcileValidationSets(manifest, []*image.ValidationSetPin{
+		{AccountID: "canonical", Name: "base-set", Sequence: 5, Mode: image.ValidationSetModePinned},
+	})
+	if err == nil {
+		t.Errorf("expected an error reporting drift")
+	}
+
+	// Missing altogether: error.
+	err = image.ReconcileValidationSets(manifest, nil)
+	if err == nil {
+		t.Errorf("expected an error reporting the pinned validation-set was not enforced")
+	}
+}
+
+func TestReadWriteSeedManifestDigestRoundTrip(t *testing.T) {
+	manifest := image.NewSeedManifest()
+	manifest.SetAllowedSnapRevision("core22", snap.R(1), "")
+	manifest.SetAllowedSnapRevision("pc", snap.R(-5), "")
+	manifest.SetAllowedSnapRevision("pc-kernel", snap.R(123),
+		"o6vJMjP1krblUDwW1j5UuW2UBOU0jUwBkP4pcmMyLASvZV03xGH4eTPFBcipKDfw")
+
+	path := filepath.Join(t.TempDir(), "seed.manifest")
+	if err := image.WriteSeedManifest(path, manifest); err != nil {
+		t.Fatalf("WriteSeedManifest failed: %v", err)
+	}
+
+	got, err := image.ReadSeedManifest(path)
+	if err != nil {
+		t.Fatalf("ReadSeedManifest failed: %v", err)
+	}
+	if !reflect.DeepEqual(got.Snaps, manifest.Snaps) {
+		t.Errorf("snaps mismatch: got %#v want %#v", got.Snaps, manifest.Snaps)
+	}
+}
+
+func TestReadSeedManifestSnapLineErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"zero revision", "core22 0\n"},
+		{"leading space", " core22 1\n"},
+		{"too many tokens", "core22 1 digest extra\n"},
+		{"bad digest", "core22 1 not-a-valid-digest\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "seed.manifest")
+			if err := ioutil.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+			if _, err := image.ReadSeedManifest(path); err == nil {
+				t.Errorf("expected an error reading manifest with content %q, got none", tc.content)
+			}
+		})
+	}
+}
+
+func TestSeedManifestSnapRevisions(t *testing.T) {
+	manifest := image.NewSeedManifest()
+	manifest.SetAllowedSnapRevision("core22", snap.R(1), "")
+	manifest.SetAllowedSnapRevision("pc", snap.R(2), "somedigest")
+
+	revisions := manifest.SnapRevisions()
+	if len(revisions) != 2 || revisions["core22"] != snap.R(1) || revisions["pc"] != snap.R(2) {
+		t.Errorf("unexpected legacy revisions map: %#v", revisions)
+	}
+}
+
+func TestCheckSnapFileDigest(t *testing.T) {
+	snapFile := filepath.Join(t.TempDir(), "test.snap")
+	if err := ioutil.WriteFile(snapFile, []byte("some snap contents"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	digest, _, err := asserts.SnapFileSHA3_384(snapFile)
+	if err != nil {
+		t.Fatalf("SnapFileSHA3_384 failed: %v", err)
+	}
+
+	manifest := image.NewSeedManifest()
+	manifest.SetAllowedSnapRevision("test-snap", snap.R(1), digest)
+
+	if err := manifest.CheckSnapFileDigest("test-snap", snapFile); err != nil {
+		t.Errorf("expected digest to match, got error: %v", err)
+	}
+
+	manifest.SetAllowedSnapRevision("tampered-snap", snap.R(1), "not-the-right-digest-"+digest[:20])
+	if err := manifest.CheckSnapFileDigest("tampered-snap", snapFile); err == nil {
+		t.Errorf("expected digest mismatch to be reported")
+	}
+
+	// No digest was pinned for this snap, so nothing to check.
+	manifest.SetAllowedSnapRevision("unpinned-snap", snap.R(1), "")
+	if err := manifest.CheckSnapFileDigest("unpinned-snap", snapFile); err != nil {
+		t.Errorf("expected no error when no digest is pinned, got: %v", err)
+	}
+}
+
+// TestWriteSeedManifestMergedAcrossSystemsIsDeterministic exercises the
+// shape of manifest GenerateSeedManifest produces once snaps and
+// validation-sets shared by more than one UC20+ system have been merged
+// into a single SeedManifest: every snap and validation-set name appears
+// exactly once, sorted, regardless of which system contributed it first.
+// GenerateSeedManifest itself needs a real prepared seed to walk, which
+// this source tree doesn't have fixtures for, so this covers the
+// resulting, already-merged manifest instead.
+func TestWriteSeedManifestMergedAcrossSystemsIsDeterministic(t *testing.T) {
+	manifest := image.NewSeedManifest()
+	manifest.Headers["timestamp"] = "2024-01-02T15:04:05Z"
+	manifest.Headers["brand"] = "canonical"
+	// Simulate "pc-kernel" being seen while processing the "dangerous"
+	// system and "core22" while processing the "signed" system: both
+	// should end up as a single entry each in the merged manifest.
+	manifest.SetAllowedSnapRevision("pc-kernel", snap.R(2), "")
+	manifest.SetAllowedSnapRevision("core22", snap.R(1), "")
+	manifest.ValidationSets = []*image.ValidationSetPin{
+		{AccountID: "canonical", Name: "zset", Sequence: 1, Mode: image.ValidationSetModePinned},
+		{AccountID: "canonical", Name: "aset", Sequence: 1, Mode: image.ValidationSetModePinned},
+	}
+
+	path := filepath.Join(t.TempDir(), "seed.manifest")
+	if err := image.WriteSeedManifest(path, manifest); err != nil {
+		t.Fatalf("WriteSeedManifest failed: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	const want = `# brand: canonical
+# timestamp: 2024-01-02T15:04:05Z
+core22 1
+pc-kernel 2
+canonical/aset=1
+canonical/zset=1
+`
+	if string(data) != want {
+		t.Errorf("unexpected seed.manifest contents:\ngot:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestReadWriteSeedManifestHeadersRoundTrip(t *testing.T) {
+	manifest := image.NewSeedManifest()
+	manifest.Headers["model"] = "canonical/ubuntu-core-22-amd64"
+	manifest.Headers["brand"] = "canonical"
+	manifest.Headers["timestamp"] = "2024-01-02T15:04:05Z"
+	manifest.Headers["snapd-version"] = "2.61"
+	manifest.SetAllowedSnapRevision("core22", snap.R(1), "")
+
+	path := filepath.Join(t.TempDir(), "seed.manifest")
+	if err := image.WriteSeedManifest(path, manifest); err != nil {
+		t.Fatalf("WriteSeedManifest failed: %v", err)
+	}
+
+	got, err := image.ReadSeedManifest(path)
+	if err != nil {
+		t.Fatalf("ReadSeedManifest failed: %v", err)
+	}
+	if !reflect.DeepEqual(got.Headers, manifest.Headers) {
+		t.Errorf("headers mismatch: got %#v want %#v", got.Headers, manifest.Headers)
+	}
+}
+
+func TestReadSeedManifestHeaderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"duplicate header", "# brand: canonical\n# brand: other\ncore22 1\n"},
+		{"bad timestamp header", "# timestamp: not-a-timestamp\ncore22 1\n"},
+		{"bad model header", "# model: not-a-valid-model-line\ncore22 1\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "seed.manifest")
+			if err := ioutil.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+			if _, err := image.ReadSeedManifest(path); err == nil {
+				t.Errorf("expected an error reading manifest with content %q, got none", tc.content)
+			}
+		})
+	}
+}
+
+func TestReadSeedManifestHeaderMustBeAtTop(t *testing.T) {
+	// A "# key: value" comment appearing after the first non-header line
+	// is free-form and must not be parsed as a header.
+	content := "core22 1\n# model: canonical/ubuntu-core-22-amd64\n"
+	path := filepath.Join(t.TempDir(), "seed.manifest")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	manifest, err := image.ReadSeedManifest(path)
+	if err != nil {
+		t.Fatalf("ReadSeedManifest failed: %v", err)
+	}
+	if len(manifest.Headers) != 0 {
+		t.Errorf("expected no headers to be parsed, got %#v", manifest.Headers)
+	}
+	if _, ok := manifest.Snaps["core22"]; !ok {
+		t.Errorf("expected core22 snap to be recorded")
+	}
+}
+
+func TestReadSeedManifestUnknownHeaderAccepted(t *testing.T) {
+	content := "# future-key: some-value\ncore22 1\n"
+	path := filepath.Join(t.TempDir(), "seed.manifest")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	manifest, err := image.ReadSeedManifest(path)
+	if err != nil {
+		t.Fatalf("ReadSeedManifest failed: %v", err)
+	}
+	if manifest.Headers["future-key"] != "some-value" {
+		t.Errorf("expected unknown header to be preserved, got %#v", manifest.Headers)
+	}
+}